@@ -0,0 +1,184 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import "math/big"
+
+// AllocationMode controls how a Range picks the next offset to hand out.
+type AllocationMode int
+
+const (
+	// RoundRobin delegates directly to the backing allocator.Interface,
+	// which may return any free offset. This is the default and matches
+	// the behavior of Range before AllocationMode existed. When AllocateNext
+	// has to skip a reserved static band, RoundRobin instead uses the same
+	// forward scan as Sequential (see allocateNextFrom).
+	RoundRobin AllocationMode = iota
+
+	// Sequential always scans forward from the last allocated offset,
+	// wrapping back to the start of the band once it reaches the end.
+	Sequential
+
+	// SerialDelayedReuse behaves like Sequential, but a released offset is
+	// held back from reuse until a full scan of the band finds nothing
+	// else free. This minimizes address churn, the same behavior Docker's
+	// lazy IP allocator and swarmkit's serial IPAM option use to avoid
+	// routing traffic to the wrong container while its old conntrack
+	// entries are still warm.
+	SerialDelayedReuse
+)
+
+// RangeOption configures optional behavior on a Range at construction time.
+type RangeOption func(*Range)
+
+// WithAllocationMode sets the AllocationMode used by AllocateNext and
+// AllocateNextStatic.
+func WithAllocationMode(mode AllocationMode) RangeOption {
+	return func(r *Range) {
+		r.mode = mode
+	}
+}
+
+// nextSequentialOffset implements the Sequential and SerialDelayedReuse
+// allocation modes, and is also used by the RoundRobin static-band skip in
+// allocator.go: it scans forward from r.lastAllocated, wrapping at r.max
+// back to min, and reserves the first offset that isn't already allocated.
+//
+// In SerialDelayedReuse mode, offsets released via releaseOffset are held
+// out of the scan (see recentlyReleased) rather than freed immediately. If a
+// full scan of the band finds nothing free, those held-back offsets are
+// merged back into the free set and the scan is retried once, so a
+// SerialDelayedReuse range can never permanently leak addresses even when
+// the rest of the band is exhausted.
+func (r *Range) nextSequentialOffset(min int) (int, bool, error) {
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+
+	offset, ok, err := r.scanLocked(min)
+	if err != nil || ok {
+		return offset, ok, err
+	}
+	if r.mode != SerialDelayedReuse || !r.mergeReleasedLocked(min) {
+		return 0, false, nil
+	}
+	return r.scanLocked(min)
+}
+
+// scanLocked does a single pass over [min, r.max), starting at
+// r.lastAllocated, reserving and returning the first free offset it finds.
+// r.modeMu must be held.
+func (r *Range) scanLocked(min int) (int, bool, error) {
+	span := r.max - min
+	if span <= 0 {
+		return 0, false, nil
+	}
+	start := r.lastAllocated
+	if start < min || start >= r.max {
+		start = min
+	}
+
+	for i := 0; i < span; i++ {
+		offset := min + (start-min+i)%span
+		if r.alloc.Has(offset) {
+			continue
+		}
+		allocated, err := r.alloc.Allocate(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if !allocated {
+			continue
+		}
+		r.lastAllocated = offset + 1
+		if r.lastAllocated >= r.max {
+			r.lastAllocated = min
+		}
+		return offset, true, nil
+	}
+	return 0, false, nil
+}
+
+// mergeReleasedLocked releases every offset held in recentlyReleased back to
+// the backing allocator and clears them, decrementing delayedReleased to
+// match. It reports whether anything was merged. r.modeMu must be held.
+func (r *Range) mergeReleasedLocked(min int) bool {
+	if r.recentlyReleased == nil {
+		return false
+	}
+	merged := false
+	for offset := min; offset < r.max; offset++ {
+		if r.recentlyReleased.Bit(offset) == 0 {
+			continue
+		}
+		r.recentlyReleased.SetBit(r.recentlyReleased, offset, 0)
+		r.alloc.Release(offset)
+		r.delayedReleased--
+		merged = true
+	}
+	return merged
+}
+
+// releaseOffset releases offset back to the pool, honoring SerialDelayedReuse
+// by holding the offset allocated in the backing store and instead marking
+// it in recentlyReleased, so it isn't handed out again until a scan of the
+// band comes up empty (see nextSequentialOffset). delayedReleased is kept in
+// sync so Range.Free/Used can still report the offset as free even though
+// the backing allocator still considers it allocated.
+func (r *Range) releaseOffset(offset int) error {
+	if r.mode != SerialDelayedReuse {
+		return r.alloc.Release(offset)
+	}
+
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+	if r.recentlyReleased == nil {
+		r.recentlyReleased = big.NewInt(0)
+	}
+	if r.recentlyReleased.Bit(offset) == 0 {
+		r.recentlyReleased.SetBit(r.recentlyReleased, offset, 1)
+		r.delayedReleased++
+	}
+	return nil
+}
+
+// delayedCount returns the number of offsets currently held back by
+// SerialDelayedReuse, i.e. released by the caller but not yet merged back
+// into the backing allocator's free set.
+func (r *Range) delayedCount() int {
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+	return r.delayedReleased
+}
+
+// isDelayedFree reports whether offset is currently held back by
+// SerialDelayedReuse: released by the caller and counted as free by
+// Free/delayedCount, but still marked allocated in r.alloc pending a merge.
+// Has and ForEach call this so they agree with Free() instead of still
+// treating the offset as allocated for the whole delay window.
+func (r *Range) isDelayedFree(offset int) bool {
+	if r.mode != SerialDelayedReuse {
+		return false
+	}
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+	return r.recentlyReleased != nil && r.recentlyReleased.Bit(offset) == 1
+}
+
+// reclaimDelayed reclaims offset if it is currently held back by
+// SerialDelayedReuse, so Allocate can hand a caller the exact IP it just
+// released instead of failing with ErrAllocated even though Free() already
+// counts the offset as available. It reports whether it reclaimed offset.
+func (r *Range) reclaimDelayed(offset int) bool {
+	if r.mode != SerialDelayedReuse {
+		return false
+	}
+	r.modeMu.Lock()
+	defer r.modeMu.Unlock()
+	if r.recentlyReleased == nil || r.recentlyReleased.Bit(offset) == 0 {
+		return false
+	}
+	r.recentlyReleased.SetBit(r.recentlyReleased, offset, 0)
+	r.delayedReleased--
+	return true
+}
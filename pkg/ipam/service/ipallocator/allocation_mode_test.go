@@ -0,0 +1,124 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"net"
+	"testing"
+)
+
+// TestSerialDelayedReuseMergesOnExhaustion reproduces the scenario where
+// every offset in the band has been allocated at least once and one has
+// since been released: AllocateNext must merge the held-back offset back in
+// and succeed, rather than leaking it and returning a permanent ErrFull.
+func TestSerialDelayedReuseMergesOnExhaustion(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("192.168.1.0/29") // 6 usable offsets
+	r, err := NewCIDRRange(cidr, WithAllocationMode(SerialDelayedReuse))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+
+	var allocated []net.IP
+	for i := 0; i < r.max; i++ {
+		ip, err := r.AllocateNext()
+		if err != nil {
+			t.Fatalf("AllocateNext() attempt %d: %v", i, err)
+		}
+		allocated = append(allocated, ip)
+	}
+	if _, err := r.AllocateNext(); err != ErrFull {
+		t.Fatalf("AllocateNext() on a full range = %v, want ErrFull", err)
+	}
+
+	released := allocated[1]
+	if err := r.Release(released); err != nil {
+		t.Fatalf("Release(%s): %v", released, err)
+	}
+	if got := r.Free(); got != 1 {
+		t.Fatalf("Free() after release = %d, want 1", got)
+	}
+
+	ip, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext() after release should reuse the released offset once nothing else is free, got: %v", err)
+	}
+	if !ip.Equal(released) {
+		t.Fatalf("AllocateNext() = %s, want the just-released %s", ip, released)
+	}
+	if got := r.Free(); got != 0 {
+		t.Fatalf("Free() after reallocating = %d, want 0", got)
+	}
+}
+
+// TestSerialDelayedReuseAvoidsImmediateReuse checks the actual delay
+// behavior: while other offsets are still free, a released offset is not
+// handed back out immediately.
+func TestSerialDelayedReuseAvoidsImmediateReuse(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("192.168.1.0/28") // 14 usable offsets
+	r, err := NewCIDRRange(cidr, WithAllocationMode(SerialDelayedReuse))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+
+	first, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext(): %v", err)
+	}
+	if err := r.Release(first); err != nil {
+		t.Fatalf("Release(%s): %v", first, err)
+	}
+
+	next, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext(): %v", err)
+	}
+	if next.Equal(first) {
+		t.Fatalf("AllocateNext() reused %s immediately after release, want a different offset while the band still has free space", first)
+	}
+}
+
+// TestSerialDelayedReuseReleaseThenAllocateSameIP checks that Has/Allocate
+// agree with Free() about a just-released offset: a caller re-requesting
+// the exact IP it released (a normal churn-avoidance pattern) must succeed
+// and see Has() report it as free beforehand, instead of being told the IP
+// is still allocated while Free() already counts it as available.
+func TestSerialDelayedReuseReleaseThenAllocateSameIP(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("192.168.1.0/28") // 14 usable offsets
+	r, err := NewCIDRRange(cidr, WithAllocationMode(SerialDelayedReuse))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+
+	ip, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext(): %v", err)
+	}
+	if err := r.Release(ip); err != nil {
+		t.Fatalf("Release(%s): %v", ip, err)
+	}
+
+	if r.Has(ip) {
+		t.Fatalf("Has(%s) = true right after Release, want false to match Free()", ip)
+	}
+	seen := false
+	r.ForEach(func(other net.IP) {
+		if other.Equal(ip) {
+			seen = true
+		}
+	})
+	if seen {
+		t.Fatalf("ForEach visited %s as allocated right after Release", ip)
+	}
+
+	if err := r.Allocate(ip); err != nil {
+		t.Fatalf("Allocate(%s) for the just-released IP: %v", ip, err)
+	}
+	if got := r.Free(); got != r.max-1 {
+		t.Fatalf("Free() after reclaiming %s = %d, want %d", ip, got, r.max-1)
+	}
+
+	if err := r.Allocate(ip); err != ErrAllocated {
+		t.Fatalf("Allocate(%s) a second time = %v, want ErrAllocated", ip, err)
+	}
+}
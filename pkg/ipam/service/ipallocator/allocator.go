@@ -9,6 +9,8 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/cilium/cilium/pkg/ipam/service/allocator"
 )
@@ -64,10 +66,38 @@ type Range struct {
 	max int
 
 	alloc allocator.Interface
+
+	// offset is the number of low offsets, starting at 0, that are reserved
+	// for static allocation (e.g. user-specified service IPs) and therefore
+	// excluded from AllocateNext. A zero value means the whole range is
+	// dynamic, matching the behavior before static/dynamic bands existed.
+	offset int
+
+	// metrics is non-nil once EnableMetrics has been called, and records
+	// Prometheus counters/gauges for allocations, releases and occupancy.
+	metrics *metricsRecorder
+
+	// mode controls how AllocateNext and AllocateNextStatic pick offsets.
+	// The zero value, RoundRobin, preserves the original behavior.
+	mode AllocationMode
+
+	// modeMu guards lastAllocated, recentlyReleased and delayedReleased.
+	// lastAllocated is used by the Sequential and SerialDelayedReuse modes and
+	// by RoundRobin when it skips a static band; the other two are only used
+	// by SerialDelayedReuse.
+	modeMu           sync.Mutex
+	lastAllocated    int
+	recentlyReleased *big.Int
+	// delayedReleased is the number of bits currently set in
+	// recentlyReleased, i.e. offsets the caller has released but that are
+	// still marked allocated in r.alloc pending a SerialDelayedReuse merge.
+	// Free/Used subtract it out so occupancy is reported truthfully.
+	delayedReleased int
 }
 
 // NewAllocatorCIDRRange creates a Range over a net.IPNet, calling allocatorFactory to construct the backing store.
-func NewAllocatorCIDRRange(cidr *net.IPNet, allocatorFactory allocator.AllocatorFactory) (*Range, error) {
+// Any RangeOptions, such as WithAllocationMode, are applied before the Range is returned.
+func NewAllocatorCIDRRange(cidr *net.IPNet, allocatorFactory allocator.AllocatorFactory, opts ...RangeOption) (*Range, error) {
 	max := RangeSize(cidr)
 	base := bigForIP(cidr.IP)
 	rangeSpec := cidr.String()
@@ -79,14 +109,20 @@ func NewAllocatorCIDRRange(cidr *net.IPNet, allocatorFactory allocator.Allocator
 	}
 	var err error
 	r.alloc, err = allocatorFactory(r.max, rangeSpec)
-	return &r, err
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(&r)
+	}
+	return &r, nil
 }
 
 // Helper that wraps NewAllocatorCIDRRange, for creating a range backed by an in-memory store.
-func NewCIDRRange(cidr *net.IPNet) (*Range, error) {
+func NewCIDRRange(cidr *net.IPNet, opts ...RangeOption) (*Range, error) {
 	return NewAllocatorCIDRRange(cidr, func(max int, rangeSpec string) (allocator.Interface, error) {
 		return allocator.NewAllocationMap(max, rangeSpec), nil
-	})
+	}, opts...)
 }
 
 func maximum(a, b int) int {
@@ -96,14 +132,17 @@ func maximum(a, b int) int {
 	return b
 }
 
-// Free returns the count of IP addresses left in the range.
+// Free returns the count of IP addresses left in the range. An IP released
+// under SerialDelayedReuse counts as free as soon as Release returns, even
+// though AllocateNext doesn't hand it out again until a scan of the band
+// finds nothing else free (see nextSequentialOffset).
 func (r *Range) Free() int {
-	return r.alloc.Free()
+	return r.alloc.Free() + r.delayedCount()
 }
 
 // Used returns the count of IP addresses used in the range.
 func (r *Range) Used() int {
-	return r.max - r.alloc.Free()
+	return r.max - r.Free()
 }
 
 // CIDR returns the CIDR covered by the range.
@@ -121,29 +160,129 @@ func (r *Range) Allocate(ip net.IP) error {
 		return &ErrNotInRange{r.net.String()}
 	}
 
+	if r.reclaimDelayed(offset) {
+		r.metrics.recordAllocation(r)
+		return nil
+	}
+
 	allocated, err := r.alloc.Allocate(offset)
 	if err != nil {
+		r.metrics.recordAllocationError(allocationScopeStatic)
 		return err
 	}
 	if !allocated {
+		r.metrics.recordAllocationError(allocationScopeStatic)
 		return ErrAllocated
 	}
+	r.metrics.recordAllocation(r)
 	return nil
 }
 
-// AllocateNext reserves one of the IPs from the pool. ErrFull may
-// be returned if there are no addresses left.
+// AllocateNext reserves one of the IPs from the dynamic band of the pool,
+// i.e. it never hands out an offset reserved by NewCIDRRangeWithOffset for
+// static allocation. ErrFull may be returned if there are no addresses left
+// in the dynamic band. Use AllocateNextStatic to also consider the static
+// band.
 func (r *Range) AllocateNext() (net.IP, error) {
-	offset, ok, err := r.alloc.AllocateNext()
+	start := time.Now()
+	offset, ok, err := r.allocateNextFrom(r.offset)
+	r.metrics.observeAllocationDuration(start)
+	if err != nil {
+		r.metrics.recordAllocationError(allocationScopeDynamic)
+		return nil, err
+	}
+	if !ok {
+		r.metrics.recordAllocationError(allocationScopeDynamic)
+		return nil, ErrFull
+	}
+	r.metrics.recordAllocation(r)
+	return addIPOffset(r.base, offset), nil
+}
+
+// AllocateNextStatic reserves the next available IP, preferring the static
+// band [0, r.offset) reserved by NewCIDRRangeWithOffset so a static
+// allocation doesn't consume the dynamic capacity AllocateNext hands out.
+// Once the static band is full it falls back to the whole range, so it may
+// still return an offset >= r.offset. It is meant for callers that manage
+// the static band themselves, such as a controller handing out LoadBalancer
+// VIPs.
+func (r *Range) AllocateNextStatic() (net.IP, error) {
+	start := time.Now()
+	offset, ok, err := r.allocateStaticFrom()
+	r.metrics.observeAllocationDuration(start)
 	if err != nil {
+		r.metrics.recordAllocationError(allocationScopeStatic)
 		return nil, err
 	}
 	if !ok {
+		r.metrics.recordAllocationError(allocationScopeStatic)
 		return nil, ErrFull
 	}
+	r.metrics.recordAllocation(r)
 	return addIPOffset(r.base, offset), nil
 }
 
+// AllocateService reserves ip for use, the same as Allocate, but makes
+// explicit that the caller intends to hand out a specific IP from either
+// band, such as a user-requested service IP that happens to fall within the
+// reserved static band.
+func (r *Range) AllocateService(ip net.IP) error {
+	return r.Allocate(ip)
+}
+
+// allocateNextFrom reserves the next available offset that is >= min,
+// honoring r.mode to decide how the offset is picked.
+//
+// When min is 0, i.e. there is no reserved static band to skip, RoundRobin
+// delegates straight to the backing allocator.Interface for an unbiased
+// pick. Otherwise it falls back to the same deterministic band scan used by
+// Sequential/SerialDelayedReuse instead of repeatedly allocating-then-
+// releasing offsets in the static band: that approach could transiently
+// expose a static offset as allocated to a concurrent Has/ForEach caller,
+// and could exhaust its retry budget and report a spurious ErrFull if the
+// backing allocator kept re-picking the same static offsets.
+func (r *Range) allocateNextFrom(min int) (int, bool, error) {
+	if min == 0 && r.mode == RoundRobin {
+		return r.alloc.AllocateNext()
+	}
+	return r.nextSequentialOffset(min)
+}
+
+// allocateStaticFrom reserves an offset for AllocateNextStatic. If the range
+// has a reserved static band, it scans that band first so a static
+// allocation can't land in the dynamic band and starve AllocateNext; only
+// once the static band is full does it fall back to allocateNextFrom(0),
+// which considers the whole range regardless of r.mode.
+func (r *Range) allocateStaticFrom() (int, bool, error) {
+	if r.offset > 0 {
+		offset, ok, err := r.scanStaticBand()
+		if err != nil || ok {
+			return offset, ok, err
+		}
+	}
+	return r.allocateNextFrom(0)
+}
+
+// scanStaticBand reserves the first free offset in [0, r.offset). It always
+// scans forward from 0 rather than honoring r.mode's round-robin/sequential
+// cursor, since the static band is a separate, typically small reservation
+// whose allocation order doesn't need to match the dynamic band's.
+func (r *Range) scanStaticBand() (int, bool, error) {
+	for offset := 0; offset < r.offset; offset++ {
+		if r.alloc.Has(offset) {
+			continue
+		}
+		allocated, err := r.alloc.Allocate(offset)
+		if err != nil {
+			return 0, false, err
+		}
+		if allocated {
+			return offset, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
 // Release releases the IP back to the pool. Releasing an
 // unallocated IP or an IP out of the range is a no-op and
 // returns no error.
@@ -153,24 +292,38 @@ func (r *Range) Release(ip net.IP) error {
 		return nil
 	}
 
-	return r.alloc.Release(offset)
+	if err := r.releaseOffset(offset); err != nil {
+		return err
+	}
+	r.metrics.recordRelease(r)
+	return nil
 }
 
-// ForEach calls the provided function for each allocated IP.
+// ForEach calls the provided function for each allocated IP. An offset held
+// back by SerialDelayedReuse is skipped, consistent with Free/Has already
+// treating it as available.
 func (r *Range) ForEach(fn func(net.IP)) {
 	r.alloc.ForEach(func(offset int) {
+		if r.isDelayedFree(offset) {
+			return
+		}
 		ip, _ := GetIndexedIP(r.net, offset+1) // +1 because Range doesn't store IP 0
 		fn(ip)
 	})
 }
 
 // Has returns true if the provided IP is already allocated and a call
-// to Allocate(ip) would fail with ErrAllocated.
+// to Allocate(ip) would fail with ErrAllocated. An offset held back by
+// SerialDelayedReuse reports false here, matching Free() already counting
+// it as available.
 func (r *Range) Has(ip net.IP) bool {
 	ok, offset := r.contains(ip)
 	if !ok {
 		return false
 	}
+	if r.isDelayedFree(offset) {
+		return false
+	}
 
 	return r.alloc.Has(offset)
 }
@@ -0,0 +1,238 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+// Copyright The Kubernetes Authors.
+
+package ipallocator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net"
+	"sync"
+)
+
+// ErrCIDRRangeNoCIDRsRemaining is returned by CIDRSet.AllocateNext when every
+// sub-CIDR block of the parent CIDR has already been occupied.
+var ErrCIDRRangeNoCIDRsRemaining = errors.New("CIDR allocation failed; there are no remaining CIDRs left to allocate in the accepted range")
+
+// maxSubNetDiffBits caps how many bits of the difference between the
+// sub-CIDR mask and the cluster CIDR's mask CIDRSet tracks, which bounds the
+// size of CIDRSet's bitmap to 2^16 blocks. NewCIDRSet accepts a larger
+// difference, but then only the first 2^16 blocks are handed out.
+const maxSubNetDiffBits = 16
+
+// CIDRSet allocates fixed-size sub-CIDRs (e.g. /26 node PodCIDRs) out of a
+// parent cluster CIDR, in the style of the Kubernetes node-ipam
+// cidrset.CidrSet. Unlike Range, which hands out individual IPs, CIDRSet
+// hands out whole blocks.
+type CIDRSet struct {
+	mu sync.Mutex
+
+	clusterCIDR     *net.IPNet
+	clusterMaskSize int
+	familyBits      int
+	subNetMaskSize  int
+
+	// maxCIDRs is 2^(subNetMaskSize-clusterMaskSize), capped at
+	// 2^maxSubNetDiffBits so the bitmap below stays bounded.
+	maxCIDRs int
+	// used has bit i set when the i'th sub-CIDR block has been allocated or
+	// occupied.
+	used big.Int
+	// nextCandidate is the block index AllocateNext resumes scanning from.
+	nextCandidate int
+}
+
+// NewCIDRSet creates a CIDRSet that hands out /subNetMaskSize blocks carved
+// out of clusterCIDR.
+func NewCIDRSet(clusterCIDR *net.IPNet, subNetMaskSize int) (*CIDRSet, error) {
+	clusterMaskSize, familyBits := clusterCIDR.Mask.Size()
+	if subNetMaskSize < clusterMaskSize {
+		return nil, fmt.Errorf("the subnet mask size %d must be greater than or equal to the cluster mask size %d", subNetMaskSize, clusterMaskSize)
+	}
+	if subNetMaskSize > familyBits {
+		return nil, fmt.Errorf("the subnet mask size %d exceeds the address length %d", subNetMaskSize, familyBits)
+	}
+
+	maxCIDRBits := subNetMaskSize - clusterMaskSize
+	if maxCIDRBits > maxSubNetDiffBits {
+		maxCIDRBits = maxSubNetDiffBits
+	}
+
+	return &CIDRSet{
+		clusterCIDR:     clusterCIDR,
+		clusterMaskSize: clusterMaskSize,
+		familyBits:      familyBits,
+		subNetMaskSize:  subNetMaskSize,
+		maxCIDRs:        1 << uint(maxCIDRBits),
+	}, nil
+}
+
+// AllocateNext reserves and returns the next available sub-CIDR block.
+func (s *CIDRSet) AllocateNext() (*net.IPNet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	offset, ok := s.nextFreeOffsetLocked()
+	if !ok {
+		return nil, ErrCIDRRangeNoCIDRsRemaining
+	}
+	s.used.SetBit(&s.used, offset, 1)
+	s.nextCandidate = (offset + 1) % s.maxCIDRs
+	return s.indexToCIDRBlock(offset), nil
+}
+
+// Occupy marks every block overlapping cidr as allocated. cidr need not be
+// aligned to the CIDRSet's subNetMaskSize; any block it overlaps, even
+// partially, is reserved.
+func (s *CIDRSet) Occupy(cidr *net.IPNet) error {
+	begin, end, err := s.blockRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := begin; i <= end; i++ {
+		s.used.SetBit(&s.used, i, 1)
+	}
+	return nil
+}
+
+// Release marks every block overlapping cidr as free again.
+func (s *CIDRSet) Release(cidr *net.IPNet) error {
+	begin, end, err := s.blockRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := begin; i <= end; i++ {
+		s.used.SetBit(&s.used, i, 0)
+	}
+	return nil
+}
+
+// blockRange returns the inclusive range of block indices that cidr
+// overlaps, validating that cidr falls within the cluster CIDR.
+func (s *CIDRSet) blockRange(cidr *net.IPNet) (begin, end int, err error) {
+	if !s.clusterCIDR.Contains(cidr.IP) {
+		return 0, 0, &ErrNotInRange{s.clusterCIDR.String()}
+	}
+	begin, err = s.indexForIP(cidr.IP)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err = s.indexForIP(lastIP(cidr))
+	if err != nil {
+		return 0, 0, err
+	}
+	if begin > s.maxCIDRs-1 || end > s.maxCIDRs-1 {
+		return 0, 0, &ErrNotInRange{s.clusterCIDR.String()}
+	}
+	return begin, end, nil
+}
+
+// indexForIP returns the block index that ip falls into. The right shift by
+// s.familyBits-s.subNetMaskSize is done entirely in big.Int: for an IPv6
+// cluster CIDR that shift can be 64 or more (e.g. a /48 cluster handing out
+// /64s), which silently yields 0 if done as a native int shift instead, and
+// the pre-shift difference can itself need more than 64 bits to represent.
+// Only the final, bounded-by-maxCIDRs block index is narrowed to int.
+func (s *CIDRSet) indexForIP(ip net.IP) (int, error) {
+	base := bigForIP(s.clusterCIDR.IP)
+	diff := new(big.Int).Sub(bigForIP(ip), base)
+	if diff.Sign() < 0 {
+		return 0, &ErrNotInRange{s.clusterCIDR.String()}
+	}
+	shift := uint(s.familyBits - s.subNetMaskSize)
+	idx := new(big.Int).Rsh(diff, shift)
+	if !idx.IsInt64() || idx.Int64() >= int64(s.maxCIDRs) {
+		return 0, &ErrNotInRange{s.clusterCIDR.String()}
+	}
+	return int(idx.Int64()), nil
+}
+
+// indexToCIDRBlock returns the sub-CIDR covering block index. Like
+// indexForIP, the left shift that turns a block index into an address
+// offset is done in big.Int rather than as a native int shift, since it can
+// be 64 or more bits for an IPv6 cluster CIDR.
+func (s *CIDRSet) indexToCIDRBlock(index int) *net.IPNet {
+	shift := uint(s.familyBits - s.subNetMaskSize)
+	offset := new(big.Int).Lsh(big.NewInt(int64(index)), shift)
+	ip := addIPBigOffset(bigForIP(s.clusterCIDR.IP), offset)
+	if s.familyBits == 32 {
+		ip = ip.To4()
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(s.subNetMaskSize, s.familyBits)}
+}
+
+// addIPBigOffset is addIPOffset for an offset that's already a big.Int,
+// needed because a block offset can exceed what fits in an int for an IPv6
+// cluster CIDR with a much longer subnet mask.
+func addIPBigOffset(base, offset *big.Int) net.IP {
+	r := new(big.Int).Add(base, offset).Bytes()
+	r = append(make([]byte, 16), r...)
+	return net.IP(r[len(r)-16:])
+}
+
+// nextFreeOffsetLocked finds the first free block at or after
+// nextCandidate, wrapping around to the start of the bitmap if needed. It
+// scans whole machine words at a time via bits.TrailingZeros so a mostly
+// full bitmap doesn't cost a bit-by-bit walk. s.mu must be held.
+func (s *CIDRSet) nextFreeOffsetLocked() (int, bool) {
+	wordSize := bits.UintSize
+	totalWords := (s.maxCIDRs + wordSize - 1) / wordSize
+	words := s.used.Bits()
+
+	wordAt := func(w int) uint {
+		if w < len(words) {
+			return uint(words[w])
+		}
+		return 0
+	}
+	freeBitsIn := func(w int) uint {
+		free := ^wordAt(w)
+		if w == totalWords-1 {
+			validBits := s.maxCIDRs - w*wordSize
+			if validBits < wordSize {
+				free &= (uint(1) << uint(validBits)) - 1
+			}
+		}
+		return free
+	}
+
+	for _, span := range [2][2]int{{s.nextCandidate, s.maxCIDRs}, {0, s.nextCandidate}} {
+		lo, hi := span[0], span[1]
+		for candidate := lo; candidate < hi; {
+			w := candidate / wordSize
+			free := freeBitsIn(w)
+			free &^= (uint(1) << uint(candidate%wordSize)) - 1
+			if free == 0 {
+				candidate = (w + 1) * wordSize
+				continue
+			}
+			offset := w*wordSize + bits.TrailingZeros(free)
+			if offset >= hi {
+				candidate = (w + 1) * wordSize
+				continue
+			}
+			return offset, true
+		}
+	}
+	return 0, false
+}
+
+// lastIP returns the last address covered by n (its broadcast address, for
+// an IPv4 CIDR).
+func lastIP(n *net.IPNet) net.IP {
+	ip := make(net.IP, len(n.IP))
+	copy(ip, n.IP)
+	for i := range ip {
+		ip[i] |= ^n.Mask[i]
+	}
+	return ip
+}
@@ -0,0 +1,110 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"net"
+	"testing"
+)
+
+// mustParseCIDR parses s as a CIDR, failing the test immediately if it is
+// invalid, and returns only the *net.IPNet.
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("net.ParseCIDR(%q): %v", s, err)
+	}
+	return n
+}
+
+// TestCIDRSetIPv6LargeShift covers the case a native int shift gets wrong:
+// a /48 cluster CIDR handing out /64 blocks needs a 64-bit address-offset
+// shift, which silently becomes 0 on a plain `int` left/right shift.
+func TestCIDRSetIPv6LargeShift(t *testing.T) {
+	_, cluster, err := net.ParseCIDR("2001:db8::/48")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR: %v", err)
+	}
+	s, err := NewCIDRSet(cluster, 64)
+	if err != nil {
+		t.Fatalf("NewCIDRSet: %v", err)
+	}
+
+	first, err := s.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext() #1: %v", err)
+	}
+	second, err := s.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext() #2: %v", err)
+	}
+	if first.String() == second.String() {
+		t.Fatalf("AllocateNext() returned %s twice; the address offset shift likely collapsed to 0", first)
+	}
+	if first.String() != "2001:db8::/64" {
+		t.Fatalf("AllocateNext() #1 = %s, want 2001:db8::/64", first)
+	}
+	if second.String() != "2001:db8:0:1::/64" {
+		t.Fatalf("AllocateNext() #2 = %s, want 2001:db8:0:1::/64", second)
+	}
+
+	// A block far from the cluster base exercises indexForIP's big.Int
+	// right shift the same way.
+	far := mustParseCIDR(t, "2001:db8:0:8000::/64")
+	if err := s.Occupy(far); err != nil {
+		t.Fatalf("Occupy(%s): %v", far, err)
+	}
+	if err := s.Release(far); err != nil {
+		t.Fatalf("Release(%s): %v", far, err)
+	}
+}
+
+func TestCIDRSetOccupyUnalignedSubCIDR(t *testing.T) {
+	_, cluster, err := net.ParseCIDR("10.0.0.0/16")
+	if err != nil {
+		t.Fatalf("net.ParseCIDR: %v", err)
+	}
+	s, err := NewCIDRSet(cluster, 24)
+	if err != nil {
+		t.Fatalf("NewCIDRSet: %v", err)
+	}
+
+	// A /23 straddles two /24 blocks; Occupy must reserve both, so neither
+	// shows up again until explicitly released.
+	unaligned := mustParseCIDR(t, "10.0.4.0/23")
+	if err := s.Occupy(unaligned); err != nil {
+		t.Fatalf("Occupy(%s): %v", unaligned, err)
+	}
+
+	occupied := map[string]bool{"10.0.4.0/24": true, "10.0.5.0/24": true}
+	seen := map[string]bool{}
+	for {
+		cidr, err := s.AllocateNext()
+		if err == ErrCIDRRangeNoCIDRsRemaining {
+			break
+		}
+		if err != nil {
+			t.Fatalf("AllocateNext(): %v", err)
+		}
+		if occupied[cidr.String()] {
+			t.Fatalf("AllocateNext() returned %s, which Occupy(%s) should have reserved", cidr, unaligned)
+		}
+		seen[cidr.String()] = true
+	}
+	if want := 254; len(seen) != want {
+		t.Fatalf("allocated %d blocks, want %d (256 - 2 occupied)", len(seen), want)
+	}
+
+	if err := s.Release(mustParseCIDR(t, "10.0.4.0/24")); err != nil {
+		t.Fatalf("Release(10.0.4.0/24): %v", err)
+	}
+	freed, err := s.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext() after releasing 10.0.4.0/24: %v", err)
+	}
+	if freed.String() != "10.0.4.0/24" {
+		t.Fatalf("AllocateNext() = %s, want the just-released 10.0.4.0/24", freed)
+	}
+}
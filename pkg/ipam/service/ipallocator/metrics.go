@@ -0,0 +1,144 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+// Copyright The Kubernetes Authors.
+
+package ipallocator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/cilium/cilium/pkg/metrics"
+)
+
+// metricsRecorder exports the allocation activity of a Range as Prometheus
+// metrics, labeled by the CIDR of the range so that multiple ranges can be
+// observed side by side. It mirrors the instrumentation the Kubernetes
+// node-ipam cidrset controller exposes for cluster CIDR exhaustion.
+type metricsRecorder struct {
+	cidr string
+
+	allocationTotal       prometheus.Counter
+	allocationErrorsTotal *prometheus.CounterVec
+	releaseTotal          prometheus.Counter
+	allocatedIPs          prometheus.Gauge
+	availableIPs          prometheus.Gauge
+	allocationDuration    prometheus.Observer
+}
+
+const (
+	allocationScopeStatic  = "static"
+	allocationScopeDynamic = "dynamic"
+)
+
+var (
+	registerMetricsOnce sync.Once
+
+	ipallocatorAllocationTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipallocator_allocation_total",
+		Help: "Number of IP allocations from a CIDR range.",
+	}, []string{"cidr"})
+
+	ipallocatorAllocationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipallocator_allocation_errors_total",
+		Help: "Number of IP allocation errors from a CIDR range, by allocation scope.",
+	}, []string{"cidr", "scope"})
+
+	ipallocatorReleaseTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ipallocator_release_total",
+		Help: "Number of IP releases back to a CIDR range.",
+	}, []string{"cidr"})
+
+	ipallocatorAllocatedIPs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ipallocator_allocated_ips",
+		Help: "Number of IPs currently allocated out of a CIDR range.",
+	}, []string{"cidr"})
+
+	ipallocatorAvailableIPs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ipallocator_available_ips",
+		Help: "Number of IPs still available in a CIDR range.",
+	}, []string{"cidr"})
+
+	ipallocatorAllocationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "ipallocator_allocation_duration_seconds",
+		Help: "Latency of AllocateNext and AllocateNextStatic calls against a CIDR range.",
+	}, []string{"cidr"})
+)
+
+// registerMetrics registers the ipallocator collectors with Cilium's own
+// metrics registry (metrics.Registry), the same one every other agent
+// subsystem exports through, rather than the global Prometheus default
+// registry. It is safe to call multiple times; registration only happens
+// once per process.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		metrics.Registry.MustRegister(
+			ipallocatorAllocationTotal,
+			ipallocatorAllocationErrorsTotal,
+			ipallocatorReleaseTotal,
+			ipallocatorAllocatedIPs,
+			ipallocatorAvailableIPs,
+			ipallocatorAllocationDuration,
+		)
+	})
+}
+
+// EnableMetrics turns on Prometheus instrumentation for the range, labeling
+// every series with cidr. It is opt-in so that ranges created for tests or
+// short-lived tooling don't pollute the agent's metrics registry.
+func (r *Range) EnableMetrics(cidr string) {
+	registerMetrics()
+	r.metrics = &metricsRecorder{
+		cidr:                  cidr,
+		allocationTotal:       ipallocatorAllocationTotal.WithLabelValues(cidr),
+		allocationErrorsTotal: ipallocatorAllocationErrorsTotal.MustCurryWith(prometheus.Labels{"cidr": cidr}),
+		releaseTotal:          ipallocatorReleaseTotal.WithLabelValues(cidr),
+		allocatedIPs:          ipallocatorAllocatedIPs.WithLabelValues(cidr),
+		availableIPs:          ipallocatorAvailableIPs.WithLabelValues(cidr),
+		allocationDuration:    ipallocatorAllocationDuration.WithLabelValues(cidr),
+	}
+}
+
+// recordAllocation records a successful allocation and refreshes the
+// allocated/available gauges from the current state of the range.
+func (m *metricsRecorder) recordAllocation(r *Range) {
+	if m == nil {
+		return
+	}
+	m.allocationTotal.Inc()
+	m.refreshOccupancy(r)
+}
+
+// recordAllocationError records a failed allocation attempt, scoped to
+// whether it came from a static or dynamic allocation call.
+func (m *metricsRecorder) recordAllocationError(scope string) {
+	if m == nil {
+		return
+	}
+	m.allocationErrorsTotal.WithLabelValues(scope).Inc()
+}
+
+// recordRelease records a release and refreshes the occupancy gauges.
+func (m *metricsRecorder) recordRelease(r *Range) {
+	if m == nil {
+		return
+	}
+	m.releaseTotal.Inc()
+	m.refreshOccupancy(r)
+}
+
+// observeAllocationDuration records how long an AllocateNext or
+// AllocateNextStatic call took.
+func (m *metricsRecorder) observeAllocationDuration(start time.Time) {
+	if m == nil {
+		return
+	}
+	m.allocationDuration.Observe(time.Since(start).Seconds())
+}
+
+func (m *metricsRecorder) refreshOccupancy(r *Range) {
+	m.allocatedIPs.Set(float64(r.Used()))
+	m.availableIPs.Set(float64(r.Free()))
+}
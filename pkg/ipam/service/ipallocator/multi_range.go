@@ -0,0 +1,191 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+// Copyright The Kubernetes Authors.
+
+package ipallocator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrCIDRRangeInUse is returned by RemoveCIDR when the backing range still
+// has allocated IPs, to avoid silently orphaning leases that are in use.
+var ErrCIDRRangeInUse = errors.New("cannot remove a CIDR range that still has allocated IPs")
+
+// MultiRange composes an ordered, disjoint set of *Range instances behind a
+// single Interface, mirroring the MultiCIDR service allocator pattern
+// upstream Kubernetes uses to grow a service-IP pool without a restart. The
+// ranges are tried in the order they were added, so the first range added is
+// preferred for AllocateNext.
+type MultiRange struct {
+	mu     sync.RWMutex
+	ranges []*Range
+}
+
+// NewMultiCIDRRange builds a MultiRange covering the given CIDRs, in
+// priority order. Each CIDR gets its own in-memory backed Range, so IPv4 and
+// IPv6 CIDRs can be mixed freely.
+func NewMultiCIDRRange(cidrs ...*net.IPNet) (*MultiRange, error) {
+	mr := &MultiRange{}
+	for _, cidr := range cidrs {
+		if err := mr.AddCIDR(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return mr, nil
+}
+
+// AddCIDR adds a new range covering cidr to the end of the priority order,
+// so existing ranges continue to be preferred by AllocateNext.
+func (mr *MultiRange) AddCIDR(cidr *net.IPNet) error {
+	r, err := NewCIDRRange(cidr)
+	if err != nil {
+		return err
+	}
+
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.ranges = append(mr.ranges, r)
+	return nil
+}
+
+// RemoveCIDR removes the range covering cidr. It returns ErrCIDRRangeInUse
+// if the range still has allocated IPs, and a plain error if no range
+// matches cidr.
+func (mr *MultiRange) RemoveCIDR(cidr *net.IPNet) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for i, r := range mr.ranges {
+		if sameCIDR(r.CIDR(), *cidr) {
+			if r.Used() > 0 {
+				return ErrCIDRRangeInUse
+			}
+			mr.ranges = append(mr.ranges[:i], mr.ranges[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no range covering %s", cidr.String())
+}
+
+// Allocate attempts to reserve ip from whichever backing range contains it.
+func (mr *MultiRange) Allocate(ip net.IP) error {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, r := range mr.ranges {
+		if r.Has(ip) || r.net.Contains(ip) {
+			return r.Allocate(ip)
+		}
+	}
+	return &ErrNotInRange{mr.validRangesLocked()}
+}
+
+// AllocateNext reserves the next available IP, trying each backing range in
+// priority order and skipping any that return ErrFull. It only returns
+// ErrFull once every backing range is exhausted.
+func (mr *MultiRange) AllocateNext() (net.IP, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, r := range mr.ranges {
+		ip, err := r.AllocateNext()
+		if err == ErrFull {
+			continue
+		}
+		return ip, err
+	}
+	return nil, ErrFull
+}
+
+// Release releases ip back to whichever backing range contains it. Releasing
+// an IP that isn't covered by any range is a no-op, matching Range.Release.
+func (mr *MultiRange) Release(ip net.IP) error {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, r := range mr.ranges {
+		if r.net.Contains(ip) {
+			return r.Release(ip)
+		}
+	}
+	return nil
+}
+
+// ForEach calls fn for every allocated IP across all backing ranges.
+func (mr *MultiRange) ForEach(fn func(net.IP)) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, r := range mr.ranges {
+		r.ForEach(fn)
+	}
+}
+
+// Has returns true if ip is allocated in whichever backing range contains
+// it.
+func (mr *MultiRange) Has(ip net.IP) bool {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	for _, r := range mr.ranges {
+		if r.net.Contains(ip) {
+			return r.Has(ip)
+		}
+	}
+	return false
+}
+
+// CIDR returns the CIDR of the primary (first added) range.
+func (mr *MultiRange) CIDR() net.IPNet {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	if len(mr.ranges) == 0 {
+		return net.IPNet{}
+	}
+	return mr.ranges[0].CIDR()
+}
+
+// Free returns the count of IP addresses left across all backing ranges.
+func (mr *MultiRange) Free() int {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	total := 0
+	for _, r := range mr.ranges {
+		total += r.Free()
+	}
+	return total
+}
+
+// Used returns the count of IP addresses used across all backing ranges.
+func (mr *MultiRange) Used() int {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	total := 0
+	for _, r := range mr.ranges {
+		total += r.Used()
+	}
+	return total
+}
+
+// validRangesLocked renders the CIDRs of all backing ranges for error
+// messages. mr.mu must be held by the caller.
+func (mr *MultiRange) validRangesLocked() string {
+	cidrs := make([]string, 0, len(mr.ranges))
+	for _, r := range mr.ranges {
+		cidrs = append(cidrs, r.net.String())
+	}
+	return fmt.Sprintf("%v", cidrs)
+}
+
+func sameCIDR(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && a.Mask.String() == b.Mask.String()
+}
+
+var _ Interface = &MultiRange{}
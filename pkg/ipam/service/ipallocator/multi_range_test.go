@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMultiRangeAddRemoveCIDR(t *testing.T) {
+	v4 := mustParseCIDR(t, "10.0.0.0/29") // 6 usable offsets
+	mr, err := NewMultiCIDRRange(v4)
+	if err != nil {
+		t.Fatalf("NewMultiCIDRRange: %v", err)
+	}
+
+	v6 := mustParseCIDR(t, "2001:db8::/125") // 6 usable offsets
+	if err := mr.AddCIDR(v6); err != nil {
+		t.Fatalf("AddCIDR(%s): %v", v6, err)
+	}
+
+	if err := mr.RemoveCIDR(mustParseCIDR(t, "10.0.1.0/29")); err == nil {
+		t.Fatalf("RemoveCIDR() for a CIDR that was never added = nil error, want an error")
+	}
+
+	ip, err := mr.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext(): %v", err)
+	}
+	if !v4.Contains(ip) {
+		t.Fatalf("AllocateNext() = %s, want an IP from the first-added range %s", ip, v4)
+	}
+
+	if err := mr.RemoveCIDR(v4); err != ErrCIDRRangeInUse {
+		t.Fatalf("RemoveCIDR(%s) with an allocated IP = %v, want ErrCIDRRangeInUse", v4, err)
+	}
+
+	if err := mr.Release(ip); err != nil {
+		t.Fatalf("Release(%s): %v", ip, err)
+	}
+	if err := mr.RemoveCIDR(v4); err != nil {
+		t.Fatalf("RemoveCIDR(%s) after release: %v", v4, err)
+	}
+	if got, want := mr.CIDR().String(), v6.String(); got != want {
+		t.Fatalf("CIDR() after removing the primary range = %s, want %s", got, want)
+	}
+}
+
+// TestMultiRangeMixedFamilyDispatch checks that Allocate/Has/Release dispatch
+// to whichever backing range's CIDR actually contains the IP, regardless of
+// which range was added first, so a MultiRange mixing an IPv4 and an IPv6
+// CIDR routes each family to its own range.
+func TestMultiRangeMixedFamilyDispatch(t *testing.T) {
+	v4 := mustParseCIDR(t, "10.0.0.0/29")
+	v6 := mustParseCIDR(t, "2001:db8::/125")
+	mr, err := NewMultiCIDRRange(v4, v6)
+	if err != nil {
+		t.Fatalf("NewMultiCIDRRange: %v", err)
+	}
+
+	v6IP := net.ParseIP("2001:db8::2")
+	if err := mr.Allocate(v6IP); err != nil {
+		t.Fatalf("Allocate(%s): %v", v6IP, err)
+	}
+	if !mr.Has(v6IP) {
+		t.Fatalf("Has(%s) = false right after Allocate", v6IP)
+	}
+
+	v4IP := net.ParseIP("10.0.0.2")
+	if err := mr.Allocate(v4IP); err != nil {
+		t.Fatalf("Allocate(%s): %v", v4IP, err)
+	}
+	if !mr.Has(v4IP) {
+		t.Fatalf("Has(%s) = false right after Allocate", v4IP)
+	}
+
+	if err := mr.Release(v6IP); err != nil {
+		t.Fatalf("Release(%s): %v", v6IP, err)
+	}
+	if mr.Has(v6IP) {
+		t.Fatalf("Has(%s) = true after Release", v6IP)
+	}
+	if !mr.Has(v4IP) {
+		t.Fatalf("Has(%s) = false after releasing the unrelated %s", v4IP, v6IP)
+	}
+
+	if got, want := mr.Used(), 1; got != want {
+		t.Fatalf("Used() = %d, want %d", got, want)
+	}
+}
+
+// TestMultiRangeAllocateNextSkipsFullRanges checks that AllocateNext moves
+// on to the next range in priority order once the current one returns
+// ErrFull, and only reports ErrFull itself once every range is exhausted.
+func TestMultiRangeAllocateNextSkipsFullRanges(t *testing.T) {
+	first := mustParseCIDR(t, "10.0.0.0/30") // 2 usable offsets
+	second := mustParseCIDR(t, "10.0.1.0/30")
+	mr, err := NewMultiCIDRRange(first, second)
+	if err != nil {
+		t.Fatalf("NewMultiCIDRRange: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ip, err := mr.AllocateNext()
+		if err != nil {
+			t.Fatalf("AllocateNext() attempt %d: %v", i, err)
+		}
+		if !first.Contains(ip) {
+			t.Fatalf("AllocateNext() attempt %d = %s, want an IP from %s", i, ip, first)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		ip, err := mr.AllocateNext()
+		if err != nil {
+			t.Fatalf("AllocateNext() after the first range fills up, attempt %d: %v", i, err)
+		}
+		if !second.Contains(ip) {
+			t.Fatalf("AllocateNext() attempt %d = %s, want it to fall through to %s", i, ip, second)
+		}
+	}
+
+	if _, err := mr.AllocateNext(); err != ErrFull {
+		t.Fatalf("AllocateNext() once every range is full = %v, want ErrFull", err)
+	}
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+// Copyright The Kubernetes Authors.
+
+package ipallocator
+
+import "net"
+
+// NewCIDRRangeWithOffset creates a Range over cidr whose low addresses, up to
+// a computed offset, are reserved for static allocation and therefore never
+// handed out by AllocateNext. min and max bound the size of the reserved
+// static band, and step divides the range size to compute a default: the
+// static band is min(max(min, rangeSize/step), max) addresses, or 0 if any
+// input is invalid (min, max or step <= 0, or min > max). This mirrors the
+// NodePort/ClusterIP split Kubernetes uses so that automatic assignments
+// never steal a slice reserved for user-specified service IPs.
+func NewCIDRRangeWithOffset(cidr *net.IPNet, min, max, step int) (*Range, error) {
+	r, err := NewCIDRRange(cidr)
+	if err != nil {
+		return nil, err
+	}
+	r.offset = calculateRangeOffset(r.max, min, max, step)
+	return r, nil
+}
+
+// calculateRangeOffset computes the size of the static band reserved at the
+// bottom of a range of the given size, following the same
+// min(max(min, size/step), max) formula as k8s portallocator's
+// calculateRangeOffset. It returns 0 if min, max or step is not positive, or
+// if min is greater than max.
+func calculateRangeOffset(size, min, max, step int) int {
+	if min <= 0 || max <= 0 || step <= 0 || min > max {
+		return 0
+	}
+	offset := size / step
+	if offset < min {
+		offset = min
+	}
+	if offset > max {
+		offset = max
+	}
+	return offset
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestCalculateRangeOffset(t *testing.T) {
+	cases := []struct {
+		name                 string
+		size, min, max, step int
+		want                 int
+	}{
+		{"invalid min", 256, 0, 10, 4, 0},
+		{"invalid max", 256, 1, 0, 4, 0},
+		{"invalid step", 256, 1, 10, 0, 0},
+		{"min greater than max", 256, 20, 10, 4, 0},
+		{"within bounds", 256, 1, 100, 4, 64},
+		{"clamped to min", 16, 10, 100, 4, 10},
+		{"clamped to max", 1024, 1, 50, 4, 50},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := calculateRangeOffset(c.size, c.min, c.max, c.step); got != c.want {
+				t.Errorf("calculateRangeOffset(%d, %d, %d, %d) = %d, want %d", c.size, c.min, c.max, c.step, got, c.want)
+			}
+		})
+	}
+}
+
+// TestAllocateNextNeverReportsSpuriousFull allocates every offset in the
+// static band, then checks that AllocateNext can still fill the entire
+// dynamic band without ever returning ErrFull early.
+func TestAllocateNextNeverReportsSpuriousFull(t *testing.T) {
+	_, cidr, _ := net.ParseCIDR("10.0.0.0/24") // 254 usable offsets
+	r, err := NewCIDRRangeWithOffset(cidr, 1, 100, 1)
+	if err != nil {
+		t.Fatalf("NewCIDRRangeWithOffset: %v", err)
+	}
+	if r.offset != 100 {
+		t.Fatalf("r.offset = %d, want 100", r.offset)
+	}
+
+	for i := 0; i < r.offset; i++ {
+		if _, err := r.AllocateNextStatic(); err != nil {
+			t.Fatalf("AllocateNextStatic() attempt %d: %v", i, err)
+		}
+	}
+
+	dynamicSize := r.max - r.offset
+	for i := 0; i < dynamicSize; i++ {
+		ip, err := r.AllocateNext()
+		if err != nil {
+			t.Fatalf("AllocateNext() attempt %d/%d: %v", i, dynamicSize, err)
+		}
+		if r.Has(ip) == false {
+			t.Fatalf("AllocateNext() returned %s which Has() does not recognize as allocated", ip)
+		}
+	}
+	if _, err := r.AllocateNext(); err != ErrFull {
+		t.Fatalf("AllocateNext() once the dynamic band is exhausted = %v, want ErrFull", err)
+	}
+}
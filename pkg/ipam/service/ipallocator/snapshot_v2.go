@@ -0,0 +1,113 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+// snapshotMagicV2 identifies the self-describing envelope SnapshotV2
+// produces, so RestoreV2 can tell it apart from an opaque v1 payload
+// produced by Snapshot.
+const snapshotMagicV2 = "cilium.ipallocator.snapshot"
+
+// snapshotVersionV2 is the current envelope version. It exists so a future
+// allocator backing store (e.g. a run-length or roaring-bitmap store
+// replacing AllocationMap) can introduce snapshotVersionV3 without losing
+// the ability to read state written by this version.
+const snapshotVersionV2 = 2
+
+// snapshotEnvelopeV2 is the self-describing payload written by SnapshotV2.
+// Unlike the opaque []byte produced by allocator.Snapshottable, it carries
+// enough metadata to validate and migrate a snapshot without first knowing
+// which Range it belongs to.
+type snapshotEnvelopeV2 struct {
+	Magic          string `json:"magic"`
+	Version        int    `json:"version"`
+	CIDR           string `json:"cidr"`
+	AllocatorKind  string `json:"allocatorKind"`
+	AllocatedCount int    `json:"allocatedCount"`
+	// Bitmap is the gzip-compressed payload produced by the backing
+	// allocator.Snapshottable implementation.
+	Bitmap []byte `json:"bitmap"`
+}
+
+// SnapshotV2 saves the current state of the pool as a versioned,
+// self-describing envelope, so it can be validated and migrated without
+// assuming the shape of the backing allocator.Interface implementation.
+func (r *Range) SnapshotV2() ([]byte, error) {
+	_, raw, err := r.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := compressBitmap(raw)
+	if err != nil {
+		return nil, fmt.Errorf("compressing snapshot bitmap: %w", err)
+	}
+
+	env := snapshotEnvelopeV2{
+		Magic:          snapshotMagicV2,
+		Version:        snapshotVersionV2,
+		CIDR:           r.net.String(),
+		AllocatorKind:  fmt.Sprintf("%T", r.alloc),
+		AllocatedCount: r.Used(),
+		Bitmap:         compressed,
+	}
+	return json.Marshal(env)
+}
+
+// RestoreV2 restores the pool from a SnapshotV2 envelope. It rejects a
+// snapshot taken for a different CIDR with ErrMismatchedNetwork, and falls
+// back to treating data as a v1 Restore payload if it isn't a recognized
+// envelope, so a v1 snapshot can still be migrated forward by simply calling
+// RestoreV2 on it.
+func (r *Range) RestoreV2(data []byte) error {
+	var env snapshotEnvelopeV2
+	if err := json.Unmarshal(data, &env); err != nil || env.Magic != snapshotMagicV2 {
+		return r.Restore(r.net, data)
+	}
+	if env.Version > snapshotVersionV2 {
+		return fmt.Errorf("ipallocator: snapshot version %d is newer than the supported version %d", env.Version, snapshotVersionV2)
+	}
+
+	_, cidr, err := net.ParseCIDR(env.CIDR)
+	if err != nil {
+		return fmt.Errorf("ipallocator: invalid CIDR %q in snapshot: %w", env.CIDR, err)
+	}
+	if !cidr.IP.Equal(r.net.IP) || cidr.Mask.String() != r.net.Mask.String() {
+		return ErrMismatchedNetwork
+	}
+
+	raw, err := decompressBitmap(env.Bitmap)
+	if err != nil {
+		return fmt.Errorf("decompressing snapshot bitmap: %w", err)
+	}
+	return r.Restore(cidr, raw)
+}
+
+func compressBitmap(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBitmap(compressed []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return io.ReadAll(gz)
+}
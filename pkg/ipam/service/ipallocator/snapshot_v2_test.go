@@ -0,0 +1,130 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright Authors of Cilium
+
+package ipallocator
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestSnapshotV2RoundTrip(t *testing.T) {
+	cidr := mustParseCIDR(t, "10.0.0.0/24")
+	r, err := NewCIDRRange(cidr)
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+
+	var allocated []string
+	for i := 0; i < 5; i++ {
+		ip, err := r.AllocateNext()
+		if err != nil {
+			t.Fatalf("AllocateNext() attempt %d: %v", i, err)
+		}
+		allocated = append(allocated, ip.String())
+	}
+
+	snap, err := r.SnapshotV2()
+	if err != nil {
+		t.Fatalf("SnapshotV2(): %v", err)
+	}
+
+	restored, err := NewCIDRRange(cidr)
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	if err := restored.RestoreV2(snap); err != nil {
+		t.Fatalf("RestoreV2(): %v", err)
+	}
+
+	if got, want := restored.Used(), r.Used(); got != want {
+		t.Fatalf("Used() after restore = %d, want %d", got, want)
+	}
+	for _, ip := range allocated {
+		if !restored.Has(net.ParseIP(ip)) {
+			t.Fatalf("Has(%s) = false after RestoreV2, want true", ip)
+		}
+	}
+
+	if _, err := restored.AllocateNext(); err != nil {
+		t.Fatalf("AllocateNext() on the restored range: %v", err)
+	}
+	if got, want := restored.Used(), r.Used()+1; got != want {
+		t.Fatalf("Used() after allocating on the restored range = %d, want %d", got, want)
+	}
+}
+
+func TestSnapshotV2RejectsMismatchedNetwork(t *testing.T) {
+	r, err := NewCIDRRange(mustParseCIDR(t, "10.0.0.0/24"))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	snap, err := r.SnapshotV2()
+	if err != nil {
+		t.Fatalf("SnapshotV2(): %v", err)
+	}
+
+	other, err := NewCIDRRange(mustParseCIDR(t, "10.0.1.0/24"))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	if err := other.RestoreV2(snap); err != ErrMismatchedNetwork {
+		t.Fatalf("RestoreV2() for a different CIDR = %v, want ErrMismatchedNetwork", err)
+	}
+}
+
+func TestSnapshotV2RejectsNewerVersion(t *testing.T) {
+	r, err := NewCIDRRange(mustParseCIDR(t, "10.0.0.0/24"))
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	snap, err := r.SnapshotV2()
+	if err != nil {
+		t.Fatalf("SnapshotV2(): %v", err)
+	}
+
+	var env map[string]interface{}
+	if err := json.Unmarshal(snap, &env); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	env["version"] = snapshotVersionV2 + 1
+	future, err := json.Marshal(env)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+
+	if err := r.RestoreV2(future); err == nil {
+		t.Fatalf("RestoreV2() with a newer version = nil error, want an error")
+	}
+}
+
+// TestSnapshotV2FallsBackToV1 checks that RestoreV2 can migrate a v1
+// Snapshot payload forward, since it isn't a recognized v2 envelope.
+func TestSnapshotV2FallsBackToV1(t *testing.T) {
+	cidr := mustParseCIDR(t, "10.0.0.0/24")
+	r, err := NewCIDRRange(cidr)
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	ip, err := r.AllocateNext()
+	if err != nil {
+		t.Fatalf("AllocateNext(): %v", err)
+	}
+
+	_, v1Data, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot(): %v", err)
+	}
+
+	restored, err := NewCIDRRange(cidr)
+	if err != nil {
+		t.Fatalf("NewCIDRRange: %v", err)
+	}
+	if err := restored.RestoreV2(v1Data); err != nil {
+		t.Fatalf("RestoreV2() with a v1 payload: %v", err)
+	}
+	if !restored.Has(ip) {
+		t.Fatalf("Has(%s) = false after RestoreV2 migrated a v1 payload", ip)
+	}
+}